@@ -0,0 +1,355 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!nobcache
+
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const bcacheSubsystem = "bcache"
+
+var (
+	bcachePriorityStats = kingpin.Flag("collector.bcache.priority-stats", "Expose expensive priority stats.").Default("false").Bool()
+
+	bcacheStatsPeriods = []string{"stats_total", "stats_five_minute", "stats_hour", "stats_day"}
+)
+
+type bcacheCollector struct {
+	fs string
+
+	cacheAvailablePercent typedDesc
+	cacheMode             typedDesc
+	bypassedBytes         typedDesc
+	dirtyDataBytes        typedDesc
+
+	cacheHits           typedDesc
+	cacheMisses         typedDesc
+	cacheBypassHits     typedDesc
+	cacheBypassMisses   typedDesc
+	cacheMissCollisions typedDesc
+	cacheReadaheads     typedDesc
+
+	backingDirtyDataBytes typedDesc
+
+	priorityUnusedPercent   typedDesc
+	priorityMetadataPercent typedDesc
+}
+
+func init() {
+	registerCollector("bcache", defaultEnabled, NewBcacheCollector)
+}
+
+// NewBcacheCollector returns a new Collector exposing bcache statistics.
+func NewBcacheCollector() (Collector, error) {
+	uuidLabel := []string{"uuid"}
+	periodLabel := []string{"uuid", "period"}
+	backingLabel := []string{"uuid", "backing_device"}
+
+	return &bcacheCollector{
+		fs: sysFilePath("fs/bcache"),
+
+		cacheAvailablePercent: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_available_percent"),
+			"Percentage of cache device without dirty data, usable for writeback.",
+			uuidLabel, nil,
+		), prometheus.GaugeValue},
+		cacheMode: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_mode"),
+			"The current operating mode of the cache, one of writethrough/writeback/writearound/none.",
+			[]string{"uuid", "backing_device", "mode"}, nil,
+		), prometheus.GaugeValue},
+		bypassedBytes: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "bypassed_bytes_total"),
+			"Amount of IO (both reads and writes) that has bypassed the cache.",
+			uuidLabel, nil,
+		), prometheus.CounterValue},
+		dirtyDataBytes: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "dirty_data_bytes"),
+			"Amount of dirty data in this cache set.",
+			uuidLabel, nil,
+		), prometheus.GaugeValue},
+
+		cacheHits: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_hits_total"),
+			"Hits counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+		cacheMisses: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_misses_total"),
+			"Misses counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+		cacheBypassHits: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_bypass_hits_total"),
+			"Hits for IO intended to skip the cache, counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+		cacheBypassMisses: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_bypass_misses_total"),
+			"Misses for IO intended to skip the cache, counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+		cacheMissCollisions: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_miss_collisions_total"),
+			"Instances where data insertion raced with a read and was aborted, counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+		cacheReadaheads: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "cache_readaheads_total"),
+			"Count of times readahead occurred, counted per accounting period.",
+			periodLabel, nil,
+		), prometheus.CounterValue},
+
+		backingDirtyDataBytes: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "backing_dirty_data_bytes"),
+			"Amount of dirty data for this backing device in the cache.",
+			backingLabel, nil,
+		), prometheus.GaugeValue},
+
+		priorityUnusedPercent: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "priority_stats_unused_percent"),
+			"The percentage of the cache that does not contain any data.",
+			uuidLabel, nil,
+		), prometheus.GaugeValue},
+		priorityMetadataPercent: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, bcacheSubsystem, "priority_stats_metadata_percent"),
+			"Percentage of cache device that is takes up by metadata.",
+			uuidLabel, nil,
+		), prometheus.GaugeValue},
+	}, nil
+}
+
+// parseBcacheValue parses bcache's bch_hprint pseudo-float format (e.g.
+// "1.5k", "3.9M", "512") into bytes. The fractional digits after the '.'
+// are a fixed-point remainder of the unit, not decimal digits, so "1.5k"
+// means 1*1024 + 5*1024/10.
+func parseBcacheValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	unit := uint64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	case 'T':
+		unit = 1 << 40
+	case 'P':
+		unit = 1 << 50
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	parts := strings.SplitN(s, ".", 2)
+	whole, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bcache value %q: %s", s, err)
+	}
+	value := uint64(whole) * unit
+
+	if len(parts) == 2 {
+		frac, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bcache value %q: %s", s, err)
+		}
+		scale := uint64(1)
+		for range parts[1] {
+			scale *= 10
+		}
+		value += frac * unit / scale
+	}
+
+	return value, nil
+}
+
+// currentBcacheMode extracts the active mode out of a cache_mode file,
+// whose contents look like "writethrough [writeback] writearound none" with
+// the currently selected mode bracketed.
+func currentBcacheMode(s string) string {
+	for _, mode := range strings.Fields(s) {
+		if strings.HasPrefix(mode, "[") && strings.HasSuffix(mode, "]") {
+			return strings.Trim(mode, "[]")
+		}
+	}
+	return ""
+}
+
+// backingDeviceName resolves a cache set's "bdevN" entry, which is a
+// symlink into the backing block device's own bcache directory (e.g.
+// .../devices/.../sda1/bcache), to the block device name itself ("sda1").
+// The bdevN name is only unique within that one cache set and isn't
+// meaningful on its own.
+func backingDeviceName(bdev string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(bdev)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Dir(resolved)), nil
+}
+
+func readBcacheFile(dir, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func readBcacheUint(dir, name string) (uint64, error) {
+	s, err := readBcacheFile(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	return parseBcacheValue(s)
+}
+
+func (c *bcacheCollector) Update(ch chan<- prometheus.Metric) error {
+	uuidDirs, err := filepath.Glob(filepath.Join(c.fs, "*-*"))
+	if err != nil {
+		return err
+	}
+	if len(uuidDirs) == 0 {
+		log.Debugf("No bcache instances found under %s", c.fs)
+		return nil
+	}
+
+	for _, dir := range uuidDirs {
+		uuid := filepath.Base(dir)
+		if err := c.updateCacheSet(ch, uuid, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *bcacheCollector) updateCacheSet(ch chan<- prometheus.Metric, uuid, dir string) error {
+	if pct, err := readBcacheFile(dir, "cache_available_percent"); err == nil {
+		v, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			log.Debugf("invalid cache_available_percent for %s: %s", uuid, err)
+		} else {
+			ch <- c.cacheAvailablePercent.mustNewConstMetric(v, uuid)
+		}
+	}
+
+	if bypassed, err := readBcacheUint(dir, "bypassed"); err == nil {
+		ch <- c.bypassedBytes.mustNewConstMetric(float64(bypassed), uuid)
+	}
+
+	if dirty, err := readBcacheUint(dir, "dirty_data"); err == nil {
+		ch <- c.dirtyDataBytes.mustNewConstMetric(float64(dirty), uuid)
+	}
+
+	for _, period := range bcacheStatsPeriods {
+		statsDir := filepath.Join(dir, period)
+		label := strings.TrimPrefix(period, "stats_")
+
+		for name, desc := range map[string]typedDesc{
+			"cache_hits":            c.cacheHits,
+			"cache_misses":          c.cacheMisses,
+			"cache_bypass_hits":     c.cacheBypassHits,
+			"cache_bypass_misses":   c.cacheBypassMisses,
+			"cache_miss_collisions": c.cacheMissCollisions,
+			"cache_readaheads":      c.cacheReadaheads,
+		} {
+			v, err := readBcacheUint(statsDir, name)
+			if err != nil {
+				continue
+			}
+			ch <- desc.mustNewConstMetric(float64(v), uuid, label)
+		}
+	}
+
+	backingDirs, err := filepath.Glob(filepath.Join(dir, "bdev*"))
+	if err != nil {
+		return err
+	}
+	for _, backing := range backingDirs {
+		dev, err := backingDeviceName(backing)
+		if err != nil {
+			log.Debugf("couldn't resolve backing device for %s: %s", backing, err)
+			continue
+		}
+
+		if dirty, err := readBcacheUint(backing, "dirty_data"); err == nil {
+			ch <- c.backingDirtyDataBytes.mustNewConstMetric(float64(dirty), uuid, dev)
+		}
+
+		if mode, err := readBcacheFile(backing, "cache_mode"); err == nil {
+			if current := currentBcacheMode(mode); current != "" {
+				ch <- c.cacheMode.mustNewConstMetric(1, uuid, dev, current)
+			}
+		}
+	}
+
+	if *bcachePriorityStats {
+		if err := c.updatePriorityStats(ch, uuid, dir); err != nil {
+			log.Debugf("couldn't read priority_stats for %s: %s", uuid, err)
+		}
+	}
+
+	return nil
+}
+
+// updatePriorityStats parses the (expensive to generate) priority_stats
+// file, whose contents look like:
+//
+//	Unused:		50%
+//	Metadata:	2%
+//	Average:	1921
+//	Sectors per Q:	64
+func (c *bcacheCollector) updatePriorityStats(ch chan<- prometheus.Metric, uuid, dir string) error {
+	contents, err := readBcacheFile(dir, "priority_stats")
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(fields[1]), "%"))
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+
+		switch key {
+		case "Unused":
+			ch <- c.priorityUnusedPercent.mustNewConstMetric(v, uuid)
+		case "Metadata":
+			ch <- c.priorityMetadataPercent.mustNewConstMetric(v, uuid)
+		}
+	}
+	return nil
+}
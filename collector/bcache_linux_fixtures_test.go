@@ -0,0 +1,121 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!nobcache
+
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectBcacheMetrics runs Update against the collector/fixtures/sys
+// tree (mirroring /sys/fs/bcache/<uuid>-.../... plus a symlinked bdev0,
+// the way real bcache sysfs is laid out) and returns every emitted metric
+// keyed by "name{label=value,...}".
+func collectBcacheMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	c, err := NewBcacheCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, ok := c.(*bcacheCollector)
+	if !ok {
+		t.Fatalf("NewBcacheCollector() returned %T, want *bcacheCollector", c)
+	}
+	bc.fs = "fixtures/sys/fs/bcache"
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Update(ch)
+		close(ch)
+	}()
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+
+		key := m.Desc().String()
+		for _, lp := range pb.Label {
+			key += "," + lp.GetName() + "=" + lp.GetValue()
+		}
+
+		var value float64
+		switch {
+		case pb.Gauge != nil:
+			value = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			value = pb.Counter.GetValue()
+		}
+		got[key] = value
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Update() returned error: %s", err)
+	}
+	return got
+}
+
+func findMetric(t *testing.T, metrics map[string]float64, fqName string, labelFragments ...string) float64 {
+	t.Helper()
+	for key, value := range metrics {
+		if !strings.Contains(key, fqName) {
+			continue
+		}
+		matched := true
+		for _, frag := range labelFragments {
+			if !strings.Contains(key, frag) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return value
+		}
+	}
+	t.Fatalf("no metric matching fqName=%q labels=%v found in %v", fqName, labelFragments, metrics)
+	return 0
+}
+
+func TestBcacheCollectorUpdate(t *testing.T) {
+	metrics := collectBcacheMetrics(t)
+
+	if v := findMetric(t, metrics, "node_bcache_bypassed_bytes_total"); v != 1536 {
+		t.Errorf("node_bcache_bypassed_bytes_total = %v, want 1536", v)
+	}
+
+	if v := findMetric(t, metrics, "node_bcache_dirty_data_bytes"); v != 3*(1<<20)+9*(1<<20)/10 {
+		t.Errorf("node_bcache_dirty_data_bytes = %v, want %v", v, 3*(1<<20)+9*(1<<20)/10)
+	}
+
+	if v := findMetric(t, metrics, "node_bcache_cache_hits_total", "period=total"); v != 100 {
+		t.Errorf("node_bcache_cache_hits_total{period=\"total\"} = %v, want 100", v)
+	}
+
+	if v := findMetric(t, metrics, "node_bcache_backing_dirty_data_bytes", "backing_device=sda1"); v != 0 {
+		t.Errorf("node_bcache_backing_dirty_data_bytes{backing_device=\"sda1\"} = %v, want 0", v)
+	}
+
+	if v := findMetric(t, metrics, "node_bcache_cache_mode", "backing_device=sda1", "mode=writeback"); v != 1 {
+		t.Errorf("node_bcache_cache_mode{backing_device=\"sda1\",mode=\"writeback\"} = %v, want 1", v)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!nobcache
+
+package collector
+
+import "testing"
+
+func TestParseBcacheValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "1k", want: 1024},
+		{in: "1K", want: 1024},
+		{in: "1.5k", want: 1024 + 5*1024/10},
+		{in: "3.9M", want: 3*(1<<20) + 9*(1<<20)/10},
+		{in: "1.25k", want: 1024 + 25*1024/100},
+		{in: "1G", want: 1 << 30},
+		{in: "", want: 0},
+		{in: "nope", wantErr: true},
+		{in: "1.nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBcacheValue(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBcacheValue(%q) = %d, nil; want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBcacheValue(%q) returned unexpected error: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBcacheValue(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCurrentBcacheMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "writethrough [writeback] writearound none", want: "writeback"},
+		{in: "[writethrough] writeback writearound none", want: "writethrough"},
+		{in: "writethrough writeback writearound none", want: ""},
+		{in: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := currentBcacheMode(tt.in); got != tt.want {
+			t.Errorf("currentBcacheMode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !nodiskstats
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	diskSubsystem         = "disk"
+	diskSectorSize uint64 = 512
+)
+
+var (
+	ignoredDevices = kingpin.Flag("collector.diskstats.ignored-devices", "Regexp of devices to ignore for diskstats.").Default("^(ram|loop|fd|(h|s|v|xv)d[a-z]|nvme\\d+n\\d+p)\\d+$").String()
+)
+
+// diskStat holds a single device's counters, normalized to the shape the
+// kernel's /proc/diskstats documentation describes regardless of which OS
+// backend produced them. Backends that can't source a given counter (e.g.
+// IOKit has no notion of merged requests) leave it at zero.
+type diskStat struct {
+	DeviceName string
+
+	ReadIOs      uint64
+	ReadMerges   uint64
+	ReadSectors  uint64
+	ReadTicks    uint64
+	WriteIOs     uint64
+	WriteMerges  uint64
+	WriteSectors uint64
+	WriteTicks   uint64
+
+	// ReadBytes/WriteBytes hold the exact byte counts backing
+	// read_bytes_total/written_bytes_total. Backends that only have a
+	// sector count (Linux) should set these to
+	// ReadSectors/WriteSectors * diskSectorSize; backends with a native
+	// byte count (darwin's IOKit, OpenBSD's hw.diskstats) should set them
+	// directly instead of rounding down to the nearest sector first.
+	ReadBytes  uint64
+	WriteBytes uint64
+
+	IOsInProgress   uint64
+	IOsTotalTicks   uint64
+	WeightedIOTicks uint64
+
+	// FieldCount is the number of numeric fields /proc/diskstats reported
+	// for this device: 11 on pre-4.18 kernels, 15 once discard stats were
+	// added, and 17 or 18 once flush stats were added on top of that. It is
+	// used to decide which of the fields below are actually populated, so
+	// we don't report all-zero discard/flush metrics on kernels that don't
+	// have them. Backends other than Linux leave it at 0, which also
+	// suppresses the extended metrics.
+	FieldCount int
+
+	DiscardIOs     uint64
+	DiscardMerges  uint64
+	DiscardSectors uint64
+	DiscardTicks   uint64
+
+	FlushRequestsCompleted uint64
+	FlushRequestsTicks     uint64
+
+	// Info carries static, rarely-changing device metadata. Backends that
+	// have no way to source it (currently everything but Linux) leave it
+	// zero-valued, and no node_disk_info series is emitted for that device.
+	Info diskInfo
+}
+
+// diskInfo holds the static device metadata exposed via node_disk_info.
+type diskInfo struct {
+	Model      string
+	Serial     string
+	WWN        string
+	Rotational string
+	Type       string
+}
+
+func (i diskInfo) empty() bool {
+	return i.Model == "" && i.Serial == "" && i.WWN == "" && i.Rotational == "" && i.Type == ""
+}
+
+// diskStatsSource is implemented once per OS and is responsible for
+// producing the current set of per-device counters. diskstatsCollector
+// itself stays OS agnostic and only knows how to turn a []diskStat into
+// Prometheus metrics.
+type diskStatsSource interface {
+	Stats() ([]diskStat, error)
+}
+
+// discardFieldCount and flushFieldCount are the minimum FieldCount at which
+// /proc/diskstats carries discard stats (kernel 4.18+) and flush stats
+// (kernel 5.5+), respectively. Some kernels pad the line with one extra
+// field (18 instead of 17); that extra field carries no additional metric.
+const (
+	discardFieldCount = 15
+	flushFieldCount   = 17
+)
+
+// diskMetricDesc pairs a typedDesc with the knowledge of whether its raw
+// counter is a millisecond tick count that needs converting to seconds.
+// Keeping that decision on the desc itself (rather than a list of "magic"
+// field indices in Update) means a metric's unit travels with its
+// definition instead of having to be kept in sync by hand.
+type diskMetricDesc struct {
+	typedDesc
+	perSecond bool
+}
+
+func (d diskMetricDesc) value(raw uint64) float64 {
+	v := float64(raw)
+	if d.perSecond {
+		v /= 1000.0
+	}
+	return v
+}
+
+type diskstatsCollector struct {
+	ignoredDevicesPattern *regexp.Regexp
+	descs                 []diskMetricDesc
+	discardDescs          []diskMetricDesc
+	flushDescs            []diskMetricDesc
+	infoDesc              typedDesc
+	source                diskStatsSource
+}
+
+func init() {
+	registerCollector("diskstats", defaultEnabled, NewDiskstatsCollector)
+}
+
+// NewDiskstatsCollector returns a new Collector exposing disk device stats.
+func NewDiskstatsCollector() (Collector, error) {
+	var diskLabelNames = []string{"device"}
+
+	source, err := newDiskstatsCollectorSource()
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskstatsCollector{
+		ignoredDevicesPattern: regexp.MustCompile(*ignoredDevices),
+		source:                source,
+		infoDesc: typedDesc{prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, diskSubsystem, "info"),
+			"Info of /sys/block/<block_device>.",
+			[]string{"device", "model", "serial", "wwn", "rotational", "type"},
+			nil,
+		), prometheus.GaugeValue},
+		// Docs from https://www.kernel.org/doc/Documentation/iostats.txt
+		descs: []diskMetricDesc{
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "reads_completed_total"),
+				"The total number of reads completed successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "reads_merged_total"),
+				"The total number of reads merged. See https://www.kernel.org/doc/Documentation/iostats.txt.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "read_sectors_total"),
+				"The total number of sectors read successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "read_time_seconds_total"),
+				"The total number of seconds spent by all reads.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "writes_completed_total"),
+				"The total number of writes completed successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "writes_merged_total"),
+				"The number of writes merged. See https://www.kernel.org/doc/Documentation/iostats.txt.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "written_sectors_total"),
+				"The total number of sectors written successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "write_time_seconds_total"),
+				"This is the total number of seconds spent by all writes.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "io_now"),
+				"The number of I/Os currently in progress.",
+				diskLabelNames,
+				nil,
+			), prometheus.GaugeValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "io_time_seconds_total"),
+				"Total seconds spent doing I/Os.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "io_time_weighted_seconds_total"),
+				"The weighted # of seconds spent doing I/Os. See https://www.kernel.org/doc/Documentation/iostats.txt.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "read_bytes_total"),
+				"The total number of bytes read successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "written_bytes_total"),
+				"The total number of bytes written successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+		},
+		discardDescs: []diskMetricDesc{
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "discards_completed_total"),
+				"The total number of discards completed successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "discards_merged_total"),
+				"The total number of discards merged.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "discarded_sectors_total"),
+				"The total number of sectors discarded successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "discard_time_seconds_total"),
+				"This is the total number of seconds spent by all discards.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+		},
+		flushDescs: []diskMetricDesc{
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "flush_requests_total"),
+				"The total number of flush requests completed successfully.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, false},
+			{typedDesc{prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, diskSubsystem, "flush_requests_time_seconds_total"),
+				"This is the total number of seconds spent by all flush requests.",
+				diskLabelNames,
+				nil,
+			), prometheus.CounterValue}, true},
+		},
+	}, nil
+}
+
+func (c *diskstatsCollector) Update(ch chan<- prometheus.Metric) error {
+	stats, err := c.source.Stats()
+	if err != nil {
+		return fmt.Errorf("couldn't get diskstats: %s", err)
+	}
+
+	for _, stat := range stats {
+		if c.ignoredDevicesPattern.MatchString(stat.DeviceName) {
+			log.Debugf("Ignoring device: %s", stat.DeviceName)
+			continue
+		}
+
+		values := []uint64{
+			stat.ReadIOs,
+			stat.ReadMerges,
+			stat.ReadSectors,
+			stat.ReadTicks,
+			stat.WriteIOs,
+			stat.WriteMerges,
+			stat.WriteSectors,
+			stat.WriteTicks,
+			stat.IOsInProgress,
+			stat.IOsTotalTicks,
+			stat.WeightedIOTicks,
+			stat.ReadBytes,
+			stat.WriteBytes,
+		}
+
+		for i, raw := range values {
+			ch <- c.descs[i].mustNewConstMetric(c.descs[i].value(raw), stat.DeviceName)
+		}
+
+		if stat.FieldCount >= discardFieldCount {
+			discardValues := []uint64{
+				stat.DiscardIOs,
+				stat.DiscardMerges,
+				stat.DiscardSectors,
+				stat.DiscardTicks,
+			}
+			for i, raw := range discardValues {
+				ch <- c.discardDescs[i].mustNewConstMetric(c.discardDescs[i].value(raw), stat.DeviceName)
+			}
+		}
+
+		if stat.FieldCount >= flushFieldCount {
+			flushValues := []uint64{
+				stat.FlushRequestsCompleted,
+				stat.FlushRequestsTicks,
+			}
+			for i, raw := range flushValues {
+				ch <- c.flushDescs[i].mustNewConstMetric(c.flushDescs[i].value(raw), stat.DeviceName)
+			}
+		}
+
+		if !stat.Info.empty() {
+			ch <- c.infoDesc.mustNewConstMetric(1, stat.DeviceName, stat.Info.Model, stat.Info.Serial, stat.Info.WWN, stat.Info.Rotational, stat.Info.Type)
+		}
+	}
+	return nil
+}
@@ -11,238 +11,173 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build !nodiskstats
+// +build linux,!nodiskstats
 
 package collector
 
 import (
 	"bufio"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
-	"regexp"
-	"strconv"
+	"path/filepath"
 	"strings"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs/blockdevice"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-const (
-	diskSubsystem         = "disk"
-	diskSectorSize uint64 = 512
-)
-
 var (
-	ignoredDevices = kingpin.Flag("collector.diskstats.ignored-devices", "Regexp of devices to ignore for diskstats.").Default("^(ram|loop|fd|(h|s|v|xv)d[a-z]|nvme\\d+n\\d+p)\\d+$").String()
+	udevDataPath = kingpin.Flag("collector.diskstats.udev-data-path", "udev data path.").Default("/run/udev/data").String()
 )
 
-type diskstatsCollector struct {
-	ignoredDevicesPattern *regexp.Regexp
-	descs                 []typedDesc
+// linuxDiskstatsSource reads /proc/diskstats via github.com/prometheus/procfs,
+// plus one pass of its own over the file to count each line's fields (see
+// diskstatsFieldCounts), and enriches each device with the static metadata
+// backing node_disk_info.
+type linuxDiskstatsSource struct {
+	fs      blockdevice.FS
+	sysPath string
 }
 
-func init() {
-	registerCollector("diskstats", defaultEnabled, NewDiskstatsCollector)
-}
-
-// NewDiskstatsCollector returns a new Collector exposing disk device stats.
-func NewDiskstatsCollector() (Collector, error) {
-	var diskLabelNames = []string{"device"}
-
-	return &diskstatsCollector{
-		ignoredDevicesPattern: regexp.MustCompile(*ignoredDevices),
-		// Docs from https://www.kernel.org/doc/Documentation/iostats.txt
-		descs: []typedDesc{
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "reads_completed_total"),
-					"The total number of reads completed successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "reads_merged_total"),
-					"The total number of reads merged. See https://www.kernel.org/doc/Documentation/iostats.txt.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "read_sectors_total"),
-					"The total number of sectors read successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "read_time_seconds_total"),
-					"The total number of milliseconds spent by all reads.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "writes_completed_total"),
-					"The total number of writes completed successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "writes_merged_total"),
-					"The number of writes merged. See https://www.kernel.org/doc/Documentation/iostats.txt.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "written_sectors_total"),
-					"The total number of sectors written successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "write_time_seconds_total"),
-					"This is the total number of seconds spent by all writes.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "io_now"),
-					"The number of I/Os currently in progress.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.GaugeValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "io_time_seconds_total"),
-					"Total seconds spent doing I/Os.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "io_time_weighted_seconds_total"),
-					"The weighted # of seconds spent doing I/Os. See https://www.kernel.org/doc/Documentation/iostats.txt.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "read_bytes_total"),
-					"The total number of bytes read successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-			{
-				desc: prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, diskSubsystem, "written_bytes_total"),
-					"The total number of bytes written successfully.",
-					diskLabelNames,
-					nil,
-				), valueType: prometheus.CounterValue,
-			},
-		},
-	}, nil
+func newDiskstatsCollectorSource() (diskStatsSource, error) {
+	fs, err := blockdevice.NewFS(procFilePath(""), sysFilePath(""))
+	if err != nil {
+		return nil, err
+	}
+	return &linuxDiskstatsSource{fs: fs, sysPath: sysFilePath("")}, nil
 }
 
-func (c *diskstatsCollector) Update(ch chan<- prometheus.Metric) error {
-	procDiskStats := procFilePath("diskstats")
-	diskStats, err := getDiskStats()
+func (s *linuxDiskstatsSource) Stats() ([]diskStat, error) {
+	procDiskStats, err := s.fs.ProcDiskstats()
 	if err != nil {
-		return fmt.Errorf("couldn't get diskstats: %s", err)
+		return nil, err
 	}
 
-	for dev, stats := range diskStats {
-		if c.ignoredDevicesPattern.MatchString(dev) {
-			log.Debugf("Ignoring device: %s", dev)
-			continue
-		}
-
-		if len(stats) != len(c.descs) {
-			return fmt.Errorf("invalid line for %s for %s", procDiskStats, dev)
-		}
+	fieldCounts, err := diskstatsFieldCounts(procFilePath("diskstats"))
+	if err != nil {
+		return nil, err
+	}
 
-		for i, value := range stats {
-			v, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return fmt.Errorf("invalid value %s in diskstats: %s", value, err)
-			}
-			// Convert to seconds
-			switch i {
-			case 3, 7, 9, 10:
-				v = v / 1000.0
-			}
-			ch <- c.descs[i].mustNewConstMetric(v, dev)
-		}
+	stats := make([]diskStat, 0, len(procDiskStats))
+	for _, ds := range procDiskStats {
+		stats = append(stats, diskStat{
+			DeviceName: ds.DeviceName,
+			FieldCount: fieldCounts[ds.DeviceName],
+
+			ReadIOs:      ds.ReadIOs,
+			ReadMerges:   ds.ReadMerges,
+			ReadSectors:  ds.ReadSectors,
+			ReadTicks:    ds.ReadTicks,
+			ReadBytes:    ds.ReadSectors * diskSectorSize,
+			WriteIOs:     ds.WriteIOs,
+			WriteMerges:  ds.WriteMerges,
+			WriteSectors: ds.WriteSectors,
+			WriteTicks:   ds.WriteTicks,
+			WriteBytes:   ds.WriteSectors * diskSectorSize,
+
+			IOsInProgress:   ds.IOsInProgress,
+			IOsTotalTicks:   ds.IOsTotalTicks,
+			WeightedIOTicks: ds.WeightedIOTicks,
+
+			DiscardIOs:     ds.DiscardIOs,
+			DiscardMerges:  ds.DiscardMerges,
+			DiscardSectors: ds.DiscardSectors,
+			DiscardTicks:   ds.DiscardTicks,
+
+			FlushRequestsCompleted: ds.FlushRequestsCompleted,
+			FlushRequestsTicks:     ds.FlushRequestsTicks,
+
+			Info: s.diskInfo(ds.DeviceName, ds.MajorNumber, ds.MinorNumber),
+		})
 	}
-	return nil
+	return stats, nil
 }
 
-func getDiskStats() (map[string]map[int]string, error) {
-	file, err := os.Open(procFilePath("diskstats"))
+// diskstatsFieldCounts returns, per device, how many numeric fields
+// /proc/diskstats reported for it. github.com/prometheus/procfs always
+// populates the discard/flush fields on Diskstats (as zero when the kernel
+// doesn't report them), so this is the only way to tell "genuinely zero"
+// apart from "not supported by this kernel".
+func diskstatsFieldCounts(path string) (map[string]int, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	return parseDiskStats(file)
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("invalid line in %s: %s", path, scanner.Text())
+		}
+		counts[parts[2]] = len(parts) - 3
+	}
+	return counts, scanner.Err()
 }
 
-func convertDiskSectorsToBytes(sectorCount string) (string, error) {
-	sectors, err := strconv.ParseUint(sectorCount, 10, 64)
-	if err != nil {
-		return "", err
+// diskInfo collects the static device metadata exposed via node_disk_info.
+// Any of it may be unavailable (e.g. non-device-mapper devices have no
+// dm/name, and not every system runs udev), in which case the
+// corresponding field is left empty.
+func (s *linuxDiskstatsSource) diskInfo(device string, major, minor uint32) diskInfo {
+	blockDir := filepath.Join(s.sysPath, "block", device)
+
+	info := diskInfo{
+		Model:      readSysFile(filepath.Join(blockDir, "device", "model")),
+		Rotational: readSysFile(filepath.Join(blockDir, "queue", "rotational")),
+		Type:       "disk",
+	}
+
+	if dmName := readSysFile(filepath.Join(blockDir, "dm", "name")); dmName != "" {
+		info.Type = "dm"
+	}
+
+	if serial, wwn := readUdevData(*udevDataPath, major, minor); serial != "" || wwn != "" {
+		info.Serial = serial
+		info.WWN = wwn
 	}
 
-	return strconv.FormatUint(sectors*diskSectorSize, 10), nil
+	if info.Model == "" && info.Rotational == "" && info.Serial == "" && info.WWN == "" && info.Type == "disk" {
+		return diskInfo{}
+	}
+	return info
 }
 
-func parseDiskStats(r io.Reader) (map[string]map[int]string, error) {
-	var (
-		diskStats = map[string]map[int]string{}
-		scanner   = bufio.NewScanner(r)
-	)
+func readSysFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
 
-	for scanner.Scan() {
-		parts := strings.Fields(scanner.Text())
-		if len(parts) < 4 { // we strip major, minor and dev
-			return nil, fmt.Errorf("invalid line in %s: %s", procFilePath("diskstats"), scanner.Text())
-		}
-		dev := parts[2]
-		diskStats[dev] = map[int]string{}
-		for i, v := range parts[3:] {
-			diskStats[dev][i] = v
+// readUdevData extracts ID_SERIAL and ID_WWN from udev's database entry for
+// a block device, e.g. /run/udev/data/b8:0. Each property is stored on its
+// own "E:KEY=VALUE" line.
+func readUdevData(udevDataPath string, major, minor uint32) (serial, wwn string) {
+	path := filepath.Join(udevDataPath, fmt.Sprintf("b%d:%d", major, minor))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "E:") {
+			continue
 		}
-		bytesRead, err := convertDiskSectorsToBytes(diskStats[dev][2])
-		if err != nil {
-			return nil, fmt.Errorf("invalid value for sectors read in %s: %s", procFilePath("diskstats"), scanner.Text())
+		kv := strings.SplitN(strings.TrimPrefix(line, "E:"), "=", 2)
+		if len(kv) != 2 {
+			continue
 		}
-		diskStats[dev][11] = bytesRead
-
-		bytesWritten, err := convertDiskSectorsToBytes(diskStats[dev][6])
-		if err != nil {
-			return nil, fmt.Errorf("invalid value for sectors written in %s: %s", procFilePath("diskstats"), scanner.Text())
+		switch kv[0] {
+		case "ID_SERIAL":
+			serial = kv[1]
+		case "ID_WWN":
+			wwn = kv[1]
 		}
-		diskStats[dev][12] = bytesWritten
 	}
-
-	return diskStats, scanner.Err()
+	return serial, wwn
 }
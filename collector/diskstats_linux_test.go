@@ -0,0 +1,76 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!nodiskstats
+
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskstatsFieldCounts(t *testing.T) {
+	const contents = `   8       0 sda 1 2 3 4 5 6 7 8 9 10 11
+   8       1 sda1 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15
+   8      16 sdb 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17
+ 253       0 dm-0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18
+`
+	want := map[string]int{
+		"sda":  11,
+		"sda1": 15,
+		"sdb":  17,
+		"dm-0": 18,
+	}
+
+	dir, err := ioutil.TempDir("", "diskstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "diskstats")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := diskstatsFieldCounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dev, wantCount := range want {
+		if got[dev] != wantCount {
+			t.Errorf("diskstatsFieldCounts()[%q] = %d, want %d", dev, got[dev], wantCount)
+		}
+	}
+}
+
+func TestDiskstatsFieldCountsInvalidLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "diskstats")
+	if err := ioutil.WriteFile(path, []byte("only two fields\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := diskstatsFieldCounts(path); err == nil {
+		t.Error("diskstatsFieldCounts() with a malformed line = nil error, want error")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build openbsd,!nodiskstats
+
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawDiskstats mirrors OpenBSD's struct diskstats from <sys/disk.h> on
+// amd64: a fixed-size name, a padded busy flag, five 64-bit counters and
+// three timeval pairs (tv_sec, tv_usec), each 16 bytes wide. Decoding it by
+// hand keeps this backend free of cgo, unlike a direct C struct cast would
+// require, so it still cross-compiles with CGO_ENABLED=0.
+type rawDiskstats struct {
+	Name       [16]byte
+	Busy       int32
+	_          int32 // padding to the next 8-byte aligned field
+	RXfer      uint64
+	WXfer      uint64
+	Seek       uint64
+	RBytes     uint64
+	WBytes     uint64
+	Attachtime [2]int64
+	Timestamp  [2]int64
+	Time       [2]int64
+}
+
+// openBSDDiskstatsSource reads the kernel's hw.diskstats sysctl, which
+// yields an array of struct diskstats.
+type openBSDDiskstatsSource struct{}
+
+func newDiskstatsCollectorSource() (diskStatsSource, error) {
+	return &openBSDDiskstatsSource{}, nil
+}
+
+func (s *openBSDDiskstatsSource) Stats() ([]diskStat, error) {
+	buf, err := unix.SysctlRaw("hw.diskstats")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read hw.diskstats: %s", err)
+	}
+
+	entrySize := binary.Size(rawDiskstats{})
+	count := len(buf) / entrySize
+
+	stats := make([]diskStat, 0, count)
+	for i := 0; i < count; i++ {
+		var ds rawDiskstats
+		r := bytes.NewReader(buf[i*entrySize : (i+1)*entrySize])
+		if err := binary.Read(r, binary.LittleEndian, &ds); err != nil {
+			return nil, fmt.Errorf("couldn't decode hw.diskstats entry: %s", err)
+		}
+
+		ioTimeMillis := uint64(ds.Time[0])*1000 + uint64(ds.Time[1])/1000
+
+		stats = append(stats, diskStat{
+			DeviceName: string(bytes.TrimRight(ds.Name[:], "\x00")),
+
+			ReadIOs:     ds.RXfer,
+			ReadSectors: ds.RBytes / diskSectorSize,
+			ReadBytes:   ds.RBytes,
+
+			WriteIOs:     ds.WXfer,
+			WriteSectors: ds.WBytes / diskSectorSize,
+			WriteBytes:   ds.WBytes,
+
+			IOsTotalTicks: ioTimeMillis,
+		})
+	}
+	return stats, nil
+}